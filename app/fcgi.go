@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// FastCGI record types (FastCGI spec 3.3) this client sends or understands.
+const (
+	fcgiBeginRequest = 1
+	fcgiEndRequest   = 3
+	fcgiParams       = 4
+	fcgiStdin        = 5
+	fcgiStdout       = 6
+	fcgiStderr       = 7
+)
+
+const fcgiVersion1 = 1
+
+// fcgiRoleResponder is the only role this client ever requests: the
+// responder generates the whole response, which is all /files and /cgi
+// need (as opposed to FCGI_AUTHORIZER or FCGI_FILTER).
+const fcgiRoleResponder = 1
+
+// fcgiKeepConn is the FCGI_BEGIN_REQUEST flag asking the responder to leave
+// the connection open after FCGI_END_REQUEST, so it can be pooled the same
+// way the reverse proxy pools upstream connections.
+const fcgiKeepConn = 1
+
+const fcgiRequestComplete = 0
+
+// maxFCGIRecordLen is the largest content length a single record's 16-bit
+// length field can carry; longer streams are split across several records.
+const maxFCGIRecordLen = 65535
+
+// fcgiHeader is the fixed 8-byte record header every FastCGI record starts
+// with (FastCGI spec 3.3).
+type fcgiHeader struct {
+	typ           byte
+	requestID     uint16
+	contentLength uint16
+	paddingLength byte
+}
+
+func readFCGIHeader(r io.Reader) (fcgiHeader, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		return fcgiHeader{}, err
+	}
+	return fcgiHeader{
+		typ:           buf[1],
+		requestID:     uint16(buf[2])<<8 | uint16(buf[3]),
+		contentLength: uint16(buf[4])<<8 | uint16(buf[5]),
+		paddingLength: buf[6],
+	}, nil
+}
+
+func writeFCGIHeader(w io.Writer, typ byte, requestID uint16, contentLength int, paddingLength byte) error {
+	header := [8]byte{
+		fcgiVersion1,
+		typ,
+		byte(requestID >> 8), byte(requestID),
+		byte(contentLength >> 8), byte(contentLength),
+		paddingLength,
+		0,
+	}
+	_, err := w.Write(header[:])
+	return err
+}
+
+// fcgiParam is a single name/value pair destined for the FCGI_PARAMS
+// stream. A slice instead of a map keeps the CGI environment in a
+// deterministic order, which is easier to read off the wire.
+type fcgiParam struct {
+	name  string
+	value string
+}
+
+// encodeFCGIParams lays out params as the length-prefixed name/value pairs
+// FCGI_PARAMS carries (FastCGI spec 3.4): each length is one byte if it
+// fits in 7 bits, else four bytes with the top bit set.
+func encodeFCGIParams(params []fcgiParam) []byte {
+	var buf bytes.Buffer
+	for _, p := range params {
+		writeFCGIParamLen(&buf, len(p.name))
+		writeFCGIParamLen(&buf, len(p.value))
+		buf.WriteString(p.name)
+		buf.WriteString(p.value)
+	}
+	return buf.Bytes()
+}
+
+func writeFCGIParamLen(buf *bytes.Buffer, n int) {
+	if n < 128 {
+		buf.WriteByte(byte(n))
+		return
+	}
+	buf.WriteByte(byte(n>>24) | 0x80)
+	buf.WriteByte(byte(n >> 16))
+	buf.WriteByte(byte(n >> 8))
+	buf.WriteByte(byte(n))
+}
+
+func encodeFCGIBeginRequest(role uint16, keepConn bool) []byte {
+	var flags byte
+	if keepConn {
+		flags = fcgiKeepConn
+	}
+	return []byte{byte(role >> 8), byte(role), flags, 0, 0, 0, 0, 0}
+}
+
+// fcgiRequest is the bookkeeping for one in-flight request on a fcgiConn.
+// FCGI_STDOUT content handed to it by readLoop is queued and drained into
+// the pipe by its own pump goroutine, rather than written straight from
+// readLoop: readLoop is the only reader of the shared connection, and if it
+// blocked on this request's pipe whenever its HTTP client read slowly, it
+// would starve every other request multiplexed on the same connection.
+type fcgiRequest struct {
+	stdout *io.PipeWriter
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+	err    error
+}
+
+func newFCGIRequest(stdout *io.PipeWriter) *fcgiRequest {
+	req := &fcgiRequest{stdout: stdout}
+	req.cond = sync.NewCond(&req.mu)
+	go req.pump()
+	return req
+}
+
+// push hands content to the pump goroutine. It never blocks on the pipe
+// itself, so it's safe to call from readLoop.
+func (r *fcgiRequest) push(content []byte) {
+	r.mu.Lock()
+	r.queue = append(r.queue, content)
+	r.cond.Signal()
+	r.mu.Unlock()
+}
+
+// finish marks the request done (err is nil on a clean FCGI_END_REQUEST),
+// letting the pump goroutine close the pipe once it has drained whatever
+// was already queued.
+func (r *fcgiRequest) finish(err error) {
+	r.mu.Lock()
+	r.closed = true
+	r.err = err
+	r.cond.Signal()
+	r.mu.Unlock()
+}
+
+// pump is this request's only writer to its pipe. It blocks on a slow HTTP
+// client same as before, but that blocking is now scoped to this goroutine
+// instead of the connection's shared read loop.
+func (r *fcgiRequest) pump() {
+	for {
+		r.mu.Lock()
+		for len(r.queue) == 0 && !r.closed {
+			r.cond.Wait()
+		}
+		if len(r.queue) == 0 {
+			err := r.err
+			r.mu.Unlock()
+			r.stdout.CloseWithError(err)
+			return
+		}
+		chunk := r.queue[0]
+		r.queue = r.queue[1:]
+		r.mu.Unlock()
+
+		// A write error just means the reader gave up; keep draining the
+		// queue (cheaply, since writes after that return immediately) until
+		// finish() tells us there's nothing more coming.
+		r.stdout.Write(chunk)
+	}
+}
+
+// fcgiConn is one persistent connection to the FastCGI responder. Multiple
+// requests are multiplexed over it at once, each tagged with its own
+// request ID (FastCGI spec 3.2), the same way http2Conn multiplexes
+// streams over a single HTTP/2 connection.
+type fcgiConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	pending map[uint16]*fcgiRequest
+	nextID  uint16
+	closed  bool
+}
+
+func dialFCGI(network, address string) (*fcgiConn, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c := &fcgiConn{conn: conn, pending: make(map[uint16]*fcgiRequest)}
+	go c.readLoop()
+	return c, nil
+}
+
+// beginRequest reserves the next request ID and wires up the pipe its
+// FCGI_STDOUT content will be written to, returning the read end for the
+// caller to parse the CGI response off of.
+func (c *fcgiConn) beginRequest() (uint16, *io.PipeReader) {
+	pr, pw := io.Pipe()
+	req := newFCGIRequest(pw)
+	c.mu.Lock()
+	c.nextID++
+	id := c.nextID
+	c.pending[id] = req
+	c.mu.Unlock()
+	return id, pr
+}
+
+func (c *fcgiConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+func (c *fcgiConn) writeRecord(typ byte, requestID uint16, content []byte) error {
+	padding := (8 - len(content)%8) % 8
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := writeFCGIHeader(c.conn, typ, requestID, len(content), byte(padding)); err != nil {
+		return err
+	}
+	if len(content) > 0 {
+		if _, err := c.conn.Write(content); err != nil {
+			return err
+		}
+	}
+	if padding > 0 {
+		var pad [8]byte
+		if _, err := c.conn.Write(pad[:padding]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeStream splits r across as many typ records as it takes (each capped
+// at maxFCGIRecordLen), ending with the zero-length record that marks the
+// end of an FCGI_PARAMS or FCGI_STDIN stream.
+func (c *fcgiConn) writeStream(typ byte, requestID uint16, r io.Reader) error {
+	buf := make([]byte, maxFCGIRecordLen)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if werr := c.writeRecord(typ, requestID, buf[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return c.writeRecord(typ, requestID, nil)
+}
+
+// readLoop demultiplexes FCGI_STDOUT/FCGI_STDERR/FCGI_END_REQUEST records
+// by request ID for as long as the connection lives, handing stdout bytes
+// to the matching pending request's pipe. It's the FastCGI-side analogue of
+// handleHTTP2Connection's frame loop.
+func (c *fcgiConn) readLoop() {
+	for {
+		header, err := readFCGIHeader(c.conn)
+		if err != nil {
+			c.abortAll(err)
+			return
+		}
+
+		content := make([]byte, header.contentLength)
+		if header.contentLength > 0 {
+			if _, err := io.ReadFull(c.conn, content); err != nil {
+				c.abortAll(err)
+				return
+			}
+		}
+		if header.paddingLength > 0 {
+			if _, err := io.CopyN(io.Discard, c.conn, int64(header.paddingLength)); err != nil {
+				c.abortAll(err)
+				return
+			}
+		}
+
+		switch header.typ {
+		case fcgiStdout:
+			c.writeStdout(header.requestID, content)
+		case fcgiStderr:
+			if len(content) > 0 {
+				fmt.Print("fcgi stderr: " + string(content))
+			}
+		case fcgiEndRequest:
+			c.finishRequest(header.requestID, content)
+		}
+	}
+}
+
+func (c *fcgiConn) writeStdout(requestID uint16, content []byte) {
+	c.mu.Lock()
+	req := c.pending[requestID]
+	c.mu.Unlock()
+	if req == nil || len(content) == 0 {
+		return
+	}
+	req.push(content)
+}
+
+func (c *fcgiConn) finishRequest(requestID uint16, content []byte) {
+	c.mu.Lock()
+	req := c.pending[requestID]
+	delete(c.pending, requestID)
+	c.mu.Unlock()
+	if req == nil {
+		return
+	}
+
+	var protocolStatus byte
+	if len(content) >= 5 {
+		protocolStatus = content[4]
+	}
+	if protocolStatus != fcgiRequestComplete {
+		req.finish(fmt.Errorf("fcgi: request failed with protocol status %d", protocolStatus))
+		return
+	}
+	req.finish(nil)
+}
+
+// abortAll runs when the connection itself breaks (read error or EOF):
+// every request still waiting on this connection gets the error instead of
+// hanging forever, and the connection is marked closed so fcgiClient dials
+// a fresh one next time.
+func (c *fcgiConn) abortAll(err error) {
+	c.mu.Lock()
+	c.closed = true
+	pending := c.pending
+	c.pending = make(map[uint16]*fcgiRequest)
+	c.mu.Unlock()
+
+	for _, req := range pending {
+		req.finish(err)
+	}
+}
+
+// fcgiClient is the /files and /cgi handlers' entry point into a FastCGI
+// responder: one pooled connection per configured address, redialed
+// whenever the previous one breaks.
+type fcgiClient struct {
+	network string
+	address string
+
+	mu   sync.Mutex
+	conn *fcgiConn
+}
+
+func newFCGIClient(network, address string) *fcgiClient {
+	return &fcgiClient{network: network, address: address}
+}
+
+func (c *fcgiClient) getConn() (*fcgiConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil && !c.conn.isClosed() {
+		return c.conn, nil
+	}
+
+	conn, err := dialFCGI(c.network, c.address)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+func (c *fcgiClient) drop(conn *fcgiConn) {
+	c.mu.Lock()
+	if c.conn == conn {
+		c.conn = nil
+	}
+	c.mu.Unlock()
+	conn.conn.Close()
+}
+
+// roundTrip sends one FCGI_BEGIN_REQUEST/FCGI_PARAMS/FCGI_STDIN sequence
+// and returns a reader positioned at the start of the responder's output
+// (CGI header block followed by body) plus the closer that releases it.
+func (c *fcgiClient) roundTrip(params []fcgiParam, body io.Reader) (*bufio.Reader, io.Closer, error) {
+	conn, err := c.getConn()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, pr := conn.beginRequest()
+
+	if err := conn.writeRecord(fcgiBeginRequest, id, encodeFCGIBeginRequest(fcgiRoleResponder, true)); err != nil {
+		c.drop(conn)
+		return nil, nil, err
+	}
+	if err := conn.writeStream(fcgiParams, id, bytes.NewReader(encodeFCGIParams(params))); err != nil {
+		c.drop(conn)
+		return nil, nil, err
+	}
+	if err := conn.writeStream(fcgiStdin, id, body); err != nil {
+		c.drop(conn)
+		return nil, nil, err
+	}
+
+	return bufio.NewReader(pr), pr, nil
+}
+
+// parseFCGITarget splits a "-fcgi" flag value into the net.Dial network and
+// address it names: "tcp://host:port" or "unix:///path/to.sock".
+func parseFCGITarget(raw string) (network, address string, err error) {
+	switch {
+	case strings.HasPrefix(raw, "tcp://"):
+		return "tcp", strings.TrimPrefix(raw, "tcp://"), nil
+	case strings.HasPrefix(raw, "unix://"):
+		return "unix", strings.TrimPrefix(raw, "unix://"), nil
+	default:
+		return "", "", fmt.Errorf("fcgi: address must be tcp://host:port or unix:///path, got %q", raw)
+	}
+}
+
+// fcgiResponseBody is the response body handed back to the router. Closing
+// it releases the FastCGI connection's pipe; the underlying connection
+// itself stays pooled for the next request.
+type fcgiResponseBody struct {
+	reader *bufio.Reader
+	closer io.Closer
+}
+
+func (b *fcgiResponseBody) Read(p []byte) (int, error) {
+	return b.reader.Read(p)
+}
+
+func (b *fcgiResponseBody) Close() error {
+	return b.closer.Close()
+}
+
+// fcgiEnviron builds the CGI environment (RFC 3875) for req, the same
+// variables net/http/fcgi's client sends: the well-known SERVER_*/REQUEST_*
+// variables plus one HTTP_* variable per request header. CONTENT_LENGTH is
+// only sent when contentLength is positive, so a chunked request body
+// (length -1) goes out without one.
+func fcgiEnviron(req *http.Request, contentLength int64) []fcgiParam {
+	host, port, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host, port = req.Host, "80"
+	}
+
+	params := []fcgiParam{
+		{"REQUEST_METHOD", req.Method},
+		{"SCRIPT_NAME", req.URL.Path},
+		{"PATH_INFO", req.URL.Path},
+		{"QUERY_STRING", req.URL.RawQuery},
+		{"SERVER_PROTOCOL", req.Proto},
+		{"GATEWAY_INTERFACE", "CGI/1.1"},
+		{"SERVER_SOFTWARE", "simple-http-server"},
+		{"REMOTE_ADDR", clientHost(req.RemoteAddr)},
+		{"SERVER_NAME", host},
+		{"SERVER_PORT", port},
+	}
+	if contentLength > 0 {
+		params = append(params, fcgiParam{"CONTENT_LENGTH", strconv.FormatInt(contentLength, 10)})
+	}
+	if ct := req.Header.Get("Content-Type"); ct != "" {
+		params = append(params, fcgiParam{"CONTENT_TYPE", ct})
+	}
+	for name, values := range req.Header {
+		if name == "Content-Type" || name == "Content-Length" {
+			continue
+		}
+		params = append(params, fcgiParam{"HTTP_" + headerEnvName(name), strings.Join(values, ", ")})
+	}
+	return params
+}
+
+// headerEnvName converts an HTTP header name like "User-Agent" into the
+// HTTP_USER_AGENT form CGI environment variables use.
+func headerEnvName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// parseCGIHeaders reads the CGI-style header block a FastCGI responder's
+// stdout starts with - "Name: value" lines terminated by a blank line - and
+// splits it into an HTTP status and header set. A "Status" header selects
+// the response code; its absence means 200, per RFC 3875 6.3.
+func parseCGIHeaders(r *bufio.Reader) (int, http.Header, error) {
+	mimeHeader, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return 0, nil, err
+	}
+
+	header := http.Header(mimeHeader)
+	status := http.StatusOK
+	if s := header.Get("Status"); s != "" {
+		header.Del("Status")
+		if fields := strings.Fields(s); len(fields) > 0 {
+			if n, convErr := strconv.Atoi(fields[0]); convErr == nil {
+				status = n
+			}
+		}
+	}
+	return status, header, nil
+}
+
+// handleCGI serves the /cgi/{path...} endpoint, which only ever makes sense
+// with a FastCGI responder configured - there's no local-disk fallback the
+// way /files has.
+func (server *Server) handleCGI(req *http.Request, params map[string]string) *http.Response {
+	if server.fcgi == nil {
+		return notFoundResponse()
+	}
+	return server.handleFCGI(req)
+}
+
+// handleFCGI forwards req to the configured FastCGI responder and adapts
+// its CGI-style response back into an *http.Response, the same role
+// handleProxy plays for the reverse-proxy upstream.
+func (server *Server) handleFCGI(req *http.Request) *http.Response {
+	var body io.Reader = req.Body
+	if req.Body == nil {
+		body = http.NoBody
+	}
+
+	// req.ContentLength is -1 for a chunked request (http.ReadRequest
+	// already de-chunked it) - CONTENT_LENGTH is simply omitted rather than
+	// buffering the whole body to compute it, the same tradeoff
+	// handleFilesPost makes for chunked uploads. FCGI_STDIN's own
+	// zero-length terminating record tells the responder where the body
+	// ends regardless.
+	reader, closer, err := server.fcgi.roundTrip(fcgiEnviron(req, req.ContentLength), body)
+	if err != nil {
+		return badGatewayResponse()
+	}
+
+	status, header, err := parseCGIHeaders(reader)
+	if err != nil {
+		closer.Close()
+		return badGatewayResponse()
+	}
+
+	resp := newResponse(status)
+	resp.Header = header
+	resp.Body = &fcgiResponseBody{reader: reader, closer: closer}
+
+	if cl := header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			resp.ContentLength = n
+			return resp
+		}
+	}
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+	return resp
+}
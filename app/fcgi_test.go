@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestFCGIRequestPushDoesNotBlock guards against the bug fcgiConn.readLoop
+// used to have: pushing FCGI_STDOUT content for a request must never block
+// on that request's pipe reader, since push is called from the connection's
+// single demultiplexing read loop.
+func TestFCGIRequestPushDoesNotBlock(t *testing.T) {
+	pr, pw := io.Pipe()
+	req := newFCGIRequest(pw)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 8; i++ {
+			req.push([]byte("chunk"))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push blocked waiting for a reader, defeating request multiplexing")
+	}
+
+	req.finish(nil)
+
+	data, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := 8 * len("chunk"); len(data) != want {
+		t.Fatalf("got %d bytes, want %d", len(data), want)
+	}
+}
+
+// TestFCGIRequestUnreadStreamDoesNotStallOthers reproduces the connection-
+// wide head-of-line blocking this type fixes: request A's client never
+// reads its response body, and request B's stdout must still arrive
+// promptly instead of waiting behind A, matching the live repro in the
+// review (a slow /cgi/slow client stalling a concurrent /cgi/fast request).
+func TestFCGIRequestUnreadStreamDoesNotStallOthers(t *testing.T) {
+	_, pwA := io.Pipe()
+	reqA := newFCGIRequest(pwA)
+	defer reqA.finish(nil)
+
+	prB, pwB := io.Pipe()
+	reqB := newFCGIRequest(pwB)
+	defer reqB.finish(nil)
+
+	// Request A's pipe reader is discarded above, so it is never read from.
+	reqA.push([]byte("request A stdout, never read"))
+	reqB.push([]byte("request B stdout"))
+
+	readB := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len("request B stdout"))
+		io.ReadFull(prB, buf)
+		readB <- buf
+	}()
+
+	select {
+	case got := <-readB:
+		if string(got) != "request B stdout" {
+			t.Fatalf("got %q, want %q", got, "request B stdout")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("request B's stdout never arrived - request A's unread pipe stalled it")
+	}
+}
+
+func TestParseCGIHeadersStatusAndBody(t *testing.T) {
+	raw := "Content-Type: text/plain\r\nStatus: 404 Not Found\r\n\r\nhello"
+	reader := bufio.NewReader(strings.NewReader(raw))
+
+	status, header, err := parseCGIHeaders(reader)
+	if err != nil {
+		t.Fatalf("parseCGIHeaders: %v", err)
+	}
+	if status != 404 {
+		t.Fatalf("status = %d, want 404", status)
+	}
+	if header.Get("Status") != "" {
+		t.Fatalf("Status header should be stripped, got %q", header.Get("Status"))
+	}
+	if header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("Content-Type = %q, want text/plain", header.Get("Content-Type"))
+	}
+
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("ReadAll body: %v", err)
+	}
+	if string(body) != "hello" {
+		t.Fatalf("body = %q, want %q", body, "hello")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func (server *Server) handleEcho(req *http.Request, params map[string]string) *http.Response {
+	msg := params["msg"]
+	if len(msg) > streamingThreshold {
+		return streamingResponse(strings.NewReader(msg), "text/plain")
+	}
+	return successResponse(msg, "text/plain")
+}
+
+func (server *Server) handleUserAgent(req *http.Request, params map[string]string) *http.Response {
+	return successResponse(req.Header.Get("User-Agent"), "text/plain")
+}
+
+func (server *Server) handleFilesGet(req *http.Request, params map[string]string) *http.Response {
+	if server.fcgi != nil {
+		return server.handleFCGI(req)
+	}
+
+	filePath := server.directory + "/" + params["name"]
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return notFoundResponse()
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return notFoundResponse()
+	}
+	size := info.Size()
+
+	rangeHeader := req.Header.Get("Range")
+	if rangeHeader == "" {
+		if size > streamingThreshold {
+			return streamingResponse(file, "application/octet-stream")
+		}
+		return fileResponse(file, "application/octet-stream", size)
+	}
+
+	start, end, err := parseRangeHeader(rangeHeader, size)
+	if err != nil {
+		file.Close()
+		return rangeNotSatisfiableResponse(size)
+	}
+
+	if _, err := file.Seek(start, io.SeekStart); err != nil {
+		file.Close()
+		return rangeNotSatisfiableResponse(size)
+	}
+
+	return partialContentResponse(file, "application/octet-stream", start, end, size)
+}
+
+// parseRangeHeader parses a single "bytes=start-end" range, including the
+// open-ended "start-" and suffix "-N" forms. Multiple ranges are not
+// supported, matching net/http's own single-range fast path.
+func parseRangeHeader(header string, size int64) (start int64, end int64, err error) {
+	const prefix = "bytes="
+	if !strings.HasPrefix(header, prefix) {
+		return 0, 0, fmt.Errorf("unsupported range unit: %q", header)
+	}
+
+	spec := strings.TrimPrefix(header, prefix)
+	if strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("multiple ranges not supported")
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("malformed range: %q", header)
+	}
+	startStr, endStr := parts[0], parts[1]
+
+	switch {
+	case startStr == "" && endStr == "":
+		return 0, 0, fmt.Errorf("empty range")
+
+	case startStr == "":
+		// suffix range: last N bytes of the file
+		n, parseErr := strconv.ParseInt(endStr, 10, 64)
+		if parseErr != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid suffix length: %q", endStr)
+		}
+		if n > size {
+			n = size
+		}
+		start = size - n
+		end = size - 1
+
+	case endStr == "":
+		start, err = strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid range start: %q", startStr)
+		}
+		end = size - 1
+
+	default:
+		start, err = strconv.ParseInt(startStr, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid range start: %q", startStr)
+		}
+		end, err = strconv.ParseInt(endStr, 10, 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid range end: %q", endStr)
+		}
+	}
+
+	if start < 0 || end < start || start >= size {
+		return 0, 0, fmt.Errorf("range out of bounds: %q", header)
+	}
+	if end >= size {
+		end = size - 1
+	}
+
+	return start, end, nil
+}
+
+func (server *Server) handleFilesPost(req *http.Request, params map[string]string) *http.Response {
+	if server.fcgi != nil {
+		return server.handleFCGI(req)
+	}
+
+	filePath := server.directory + "/" + params["name"]
+
+	file, err := os.Create(filePath)
+	if err != nil {
+		return notFoundResponse()
+	}
+	defer file.Close()
+
+	// http.ReadRequest already de-chunks a "Transfer-Encoding: chunked" body,
+	// so streaming straight from req.Body handles both that and the
+	// Content-Length case without ever holding the whole upload in memory.
+	buf := make([]byte, copyBufferSize)
+	if _, err := io.CopyBuffer(file, req.Body, buf); err != nil {
+		return notFoundResponse()
+	}
+
+	return createdResponse("application/octet-stream")
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+// hpackHeaderField is a single decoded name/value pair, in the order HPACK
+// emitted it. Pseudo-headers (":method", ":path", ...) are included
+// alongside the regular fields; the caller splits them apart.
+type hpackHeaderField struct {
+	name  string
+	value string
+}
+
+// staticTable is the fixed 61-entry table from RFC 7541 Appendix A. HPACK
+// indices 1-61 refer into it; indices above that refer into the dynamic
+// table kept per connection.
+var staticTable = [61]hpackHeaderField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+var errHPACKProtocol = errors.New("hpack: malformed header block")
+
+// hpackDecoder decodes HEADERS frame payloads into name/value pairs. It
+// holds the dynamic table, so one instance must be reused for the whole
+// lifetime of an HTTP/2 connection - entries added by one HEADERS frame are
+// visible to the next.
+type hpackDecoder struct {
+	dynamic    []hpackHeaderField
+	dynSize    int
+	maxDynSize int
+}
+
+func newHPACKDecoder() *hpackDecoder {
+	return &hpackDecoder{maxDynSize: 4096}
+}
+
+func (d *hpackDecoder) tableEntry(index int) (hpackHeaderField, bool) {
+	if index >= 1 && index <= len(staticTable) {
+		return staticTable[index-1], true
+	}
+	dynIndex := index - len(staticTable) - 1
+	if dynIndex >= 0 && dynIndex < len(d.dynamic) {
+		return d.dynamic[dynIndex], true
+	}
+	return hpackHeaderField{}, false
+}
+
+func (d *hpackDecoder) addDynamic(f hpackHeaderField) {
+	d.dynamic = append([]hpackHeaderField{f}, d.dynamic...)
+	d.dynSize += len(f.name) + len(f.value) + 32
+	for d.dynSize > d.maxDynSize && len(d.dynamic) > 0 {
+		evicted := d.dynamic[len(d.dynamic)-1]
+		d.dynamic = d.dynamic[:len(d.dynamic)-1]
+		d.dynSize -= len(evicted.name) + len(evicted.value) + 32
+	}
+}
+
+// decodeFields decodes a full header block (already reassembled from
+// HEADERS/CONTINUATION frames) into its fields, in wire order.
+func (d *hpackDecoder) decodeFields(block []byte) ([]hpackHeaderField, error) {
+	var fields []hpackHeaderField
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0: // indexed header field
+			index, rest, err := decodeHPACKInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			entry, ok := d.tableEntry(index)
+			if !ok {
+				return nil, errHPACKProtocol
+			}
+			fields = append(fields, entry)
+			block = rest
+
+		case b&0x40 != 0: // literal with incremental indexing
+			field, rest, err := d.decodeLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.addDynamic(field)
+			fields = append(fields, field)
+			block = rest
+
+		case b&0x20 != 0: // dynamic table size update
+			size, rest, err := decodeHPACKInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			d.maxDynSize = size
+			for d.dynSize > d.maxDynSize && len(d.dynamic) > 0 {
+				evicted := d.dynamic[len(d.dynamic)-1]
+				d.dynamic = d.dynamic[:len(d.dynamic)-1]
+				d.dynSize -= len(evicted.name) + len(evicted.value) + 32
+			}
+			block = rest
+
+		default: // literal without indexing (0x00) or never indexed (0x10)
+			field, rest, err := d.decodeLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			block = rest
+		}
+	}
+	return fields, nil
+}
+
+// decodeLiteral decodes a literal header field whose name is either given
+// inline or referenced by index, using nameBits as the prefix length of
+// that leading index.
+func (d *hpackDecoder) decodeLiteral(block []byte, nameBits uint) (hpackHeaderField, []byte, error) {
+	index, rest, err := decodeHPACKInt(block, nameBits)
+	if err != nil {
+		return hpackHeaderField{}, nil, err
+	}
+
+	var name string
+	if index == 0 {
+		name, rest, err = decodeHPACKString(rest)
+		if err != nil {
+			return hpackHeaderField{}, nil, err
+		}
+	} else {
+		entry, ok := d.tableEntry(index)
+		if !ok {
+			return hpackHeaderField{}, nil, errHPACKProtocol
+		}
+		name = entry.name
+	}
+
+	value, rest, err := decodeHPACKString(rest)
+	if err != nil {
+		return hpackHeaderField{}, nil, err
+	}
+	return hpackHeaderField{name: name, value: value}, rest, nil
+}
+
+// decodeHPACKInt decodes RFC 7541 5.1's variable-length integer encoding,
+// where prefixBits is the width of the first byte's numeric prefix (the
+// rest of that byte is the header bits the caller already switched on).
+func decodeHPACKInt(block []byte, prefixBits uint) (int, []byte, error) {
+	if len(block) == 0 {
+		return 0, nil, errHPACKProtocol
+	}
+	mask := byte(1<<prefixBits) - 1
+	value := int(block[0] & mask)
+	block = block[1:]
+	if value < int(mask) {
+		return value, block, nil
+	}
+
+	shift := uint(0)
+	for {
+		if len(block) == 0 {
+			return 0, nil, errHPACKProtocol
+		}
+		b := block[0]
+		block = block[1:]
+		value += int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return value, block, nil
+		}
+	}
+}
+
+// decodeHPACKString decodes a length-prefixed string literal, Huffman
+// decoding it first if the high bit of its length byte is set.
+func decodeHPACKString(block []byte) (string, []byte, error) {
+	if len(block) == 0 {
+		return "", nil, errHPACKProtocol
+	}
+	huffman := block[0]&0x80 != 0
+	length, rest, err := decodeHPACKInt(block, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > len(rest) {
+		return "", nil, errHPACKProtocol
+	}
+	raw := rest[:length]
+	rest = rest[length:]
+
+	if !huffman {
+		return string(raw), rest, nil
+	}
+	decoded, err := huffmanDecode(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	return decoded, rest, nil
+}
+
+// encodeHPACKInt is the encoding counterpart of decodeHPACKInt. header
+// carries the already-positioned leading bits (e.g. 0x00 for a literal
+// without indexing); it is OR'd into the first byte alongside the prefix.
+func encodeHPACKInt(header byte, prefixBits uint, value int) []byte {
+	mask := int(1<<prefixBits) - 1
+	if value < mask {
+		return []byte{header | byte(value)}
+	}
+
+	out := []byte{header | byte(mask)}
+	value -= mask
+	for value >= 0x80 {
+		out = append(out, byte(value&0x7f|0x80))
+		value >>= 7
+	}
+	return append(out, byte(value))
+}
+
+// encodeHPACKString encodes a literal header string without Huffman coding.
+// Skipping Huffman on the encode side keeps this half of the codec simple;
+// decoding still has to handle it since we don't control what peers send.
+func encodeHPACKString(s string) []byte {
+	return append(encodeHPACKInt(0x00, 7, len(s)), s...)
+}
+
+// encodeHPACKHeaderField encodes name/value as a literal header field
+// without indexing - plain and correct, if not as compact as a real HPACK
+// encoder that tracks what it can reuse from the dynamic table.
+func encodeHPACKHeaderField(name, value string) []byte {
+	out := encodeHPACKInt(0x00, 4, 0)
+	out = append(out, encodeHPACKString(strings.ToLower(name))...)
+	out = append(out, encodeHPACKString(value)...)
+	return out
+}
+
+// huffmanCodes and huffmanCodeLen are the canonical Huffman code (RFC 7541
+// Appendix B) for each of the 256 possible header bytes: huffmanCodes[b]
+// read as the low huffmanCodeLen[b] bits, most significant bit first.
+var huffmanCodes = [256]uint32{
+	0x1ff8, 0x7fffd8, 0xfffffe2, 0xfffffe3, 0xfffffe4, 0xfffffe5, 0xfffffe6, 0xfffffe7,
+	0xfffffe8, 0xffffea, 0x3ffffffc, 0xfffffe9, 0xfffffea, 0x3ffffffd, 0xfffffeb, 0xfffffec,
+	0xfffffed, 0xfffffee, 0xfffffef, 0xffffff0, 0xffffff1, 0xffffff2, 0x3ffffffe, 0xffffff3,
+	0xffffff4, 0xffffff5, 0xffffff6, 0xffffff7, 0xffffff8, 0xffffff9, 0xffffffa, 0xffffffb,
+	0x14, 0x3f8, 0x3f9, 0xffa, 0x1ff9, 0x15, 0xf8, 0x7fa,
+	0x3fa, 0x3fb, 0xf9, 0x7fb, 0xfa, 0x16, 0x17, 0x18,
+	0x0, 0x1, 0x2, 0x19, 0x1a, 0x1b, 0x1c, 0x1d,
+	0x1e, 0x1f, 0x5c, 0xfb, 0x7ffc, 0x20, 0xffb, 0x3fc,
+	0x1ffa, 0x21, 0x5d, 0x5e, 0x5f, 0x60, 0x61, 0x62,
+	0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a,
+	0x6b, 0x6c, 0x6d, 0x6e, 0x6f, 0x70, 0x71, 0x72,
+	0xfc, 0x73, 0xfd, 0x1ffb, 0x7fff0, 0x1ffc, 0x3ffc, 0x22,
+	0x7ffd, 0x3, 0x23, 0x4, 0x24, 0x5, 0x25, 0x26,
+	0x27, 0x6, 0x74, 0x75, 0x28, 0x29, 0x2a, 0x7,
+	0x2b, 0x76, 0x2c, 0x8, 0x9, 0x2d, 0x77, 0x78,
+	0x79, 0x7a, 0x7b, 0x7ffe, 0x7fc, 0x3ffd, 0x1ffd, 0xffffffc,
+	0xfffe6, 0x3fffd2, 0xfffe7, 0xfffe8, 0x3fffd3, 0x3fffd4, 0x3fffd5, 0x7fffd9,
+	0x3fffd6, 0x7fffda, 0x7fffdb, 0x7fffdc, 0x7fffdd, 0x7fffde, 0xffffeb, 0x7fffdf,
+	0xffffec, 0xffffed, 0x3fffd7, 0x7fffe0, 0xffffee, 0x7fffe1, 0x7fffe2, 0x7fffe3,
+	0x7fffe4, 0x1fffdc, 0x3fffd8, 0x7fffe5, 0x3fffd9, 0x7fffe6, 0x7fffe7, 0xffffef,
+	0x3fffda, 0x1fffdd, 0xfffe9, 0x3fffdb, 0x3fffdc, 0x7fffe8, 0x7fffe9, 0x1fffde,
+	0x7fffea, 0x3fffdd, 0x3fffde, 0xfffff0, 0x1fffdf, 0x3fffdf, 0x7fffeb, 0x7fffec,
+	0x1fffe0, 0x1fffe1, 0x3fffe0, 0x1fffe2, 0x7fffed, 0x3fffe1, 0x7fffee, 0x7fffef,
+	0xfffea, 0x3fffe2, 0x3fffe3, 0x3fffe4, 0x7ffff0, 0x3fffe5, 0x3fffe6, 0x7ffff1,
+	0x3ffffe0, 0x3ffffe1, 0xfffeb, 0x7fff1, 0x3fffe7, 0x7ffff2, 0x3fffe8, 0x1ffffec,
+	0x3ffffe2, 0x3ffffe3, 0x3ffffe4, 0x7ffffde, 0x7ffffdf, 0x3ffffe5, 0xfffff1, 0x1ffffed,
+	0x7fff2, 0x1fffe3, 0x3ffffe6, 0x7ffffe0, 0x7ffffe1, 0x3ffffe7, 0x7ffffe2, 0xfffff2,
+	0x1fffe4, 0x1fffe5, 0x3ffffe8, 0x3ffffe9, 0xffffffd, 0x7ffffe3, 0x7ffffe4, 0x7ffffe5,
+	0xfffec, 0xfffff3, 0xfffed, 0x1fffe6, 0x3fffe9, 0x1fffe7, 0x1fffe8, 0x7ffff3,
+	0x3fffea, 0x3fffeb, 0x1ffffee, 0x1ffffef, 0xfffff4, 0xfffff5, 0x3ffffea, 0x7ffff4,
+	0x3ffffeb, 0x7ffffe6, 0x3ffffec, 0x3ffffed, 0x7ffffe7, 0x7ffffe8, 0x7ffffe9, 0x7ffffea,
+	0x7ffffeb, 0xffffffe, 0x7ffffec, 0x7ffffed, 0x7ffffee, 0x7ffffef, 0x7fffff0, 0x3ffffee,
+}
+
+var huffmanCodeLen = [256]uint8{
+	13, 23, 28, 28, 28, 28, 28, 28, 28, 24, 30, 28, 28, 30, 28, 28,
+	28, 28, 28, 28, 28, 28, 30, 28, 28, 28, 28, 28, 28, 28, 28, 28,
+	6, 10, 10, 12, 13, 6, 8, 11, 10, 10, 8, 11, 8, 6, 6, 6,
+	5, 5, 5, 6, 6, 6, 6, 6, 6, 6, 7, 8, 15, 6, 12, 10,
+	13, 6, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7, 7,
+	7, 7, 7, 7, 7, 7, 7, 7, 8, 7, 8, 13, 19, 13, 14, 6,
+	15, 5, 6, 5, 6, 5, 6, 6, 6, 5, 7, 7, 6, 6, 6, 5,
+	6, 7, 6, 5, 5, 6, 7, 7, 7, 7, 7, 15, 11, 14, 13, 28,
+	20, 22, 20, 20, 22, 22, 22, 23, 22, 23, 23, 23, 23, 23, 24, 23,
+	24, 24, 22, 23, 24, 23, 23, 23, 23, 21, 22, 23, 22, 23, 23, 24,
+	22, 21, 20, 22, 22, 23, 23, 21, 23, 22, 22, 24, 21, 22, 23, 23,
+	21, 21, 22, 21, 23, 22, 23, 23, 20, 22, 22, 22, 23, 22, 22, 23,
+	26, 26, 20, 19, 22, 23, 22, 25, 26, 26, 26, 27, 27, 26, 24, 25,
+	19, 21, 26, 27, 27, 26, 27, 24, 21, 21, 26, 26, 28, 27, 27, 27,
+	20, 24, 20, 21, 22, 21, 21, 23, 22, 22, 25, 25, 24, 24, 26, 23,
+	26, 27, 26, 26, 27, 27, 27, 27, 27, 28, 27, 27, 27, 27, 27, 26,
+}
+
+// huffmanDecode decodes a Huffman-coded string one bit at a time, checking
+// the bits accumulated so far against every known code at that length.
+// That's O(256) per bit rather than a trie lookup, but header blocks are
+// small and this isn't a hot path worth the extra bookkeeping.
+func huffmanDecode(data []byte) (string, error) {
+	var out strings.Builder
+	var code uint32
+	var nbits uint
+
+	for _, b := range data {
+		for bit := 7; bit >= 0; bit-- {
+			code = code<<1 | uint32((b>>uint(bit))&1)
+			nbits++
+			if sym, ok := huffmanLookup(code, nbits); ok {
+				out.WriteByte(byte(sym))
+				code, nbits = 0, 0
+				continue
+			}
+			if nbits > 30 {
+				return "", errHPACKProtocol
+			}
+		}
+	}
+
+	if nbits > 0 {
+		if code != 1<<nbits-1 {
+			return "", errHPACKProtocol
+		}
+	}
+	return out.String(), nil
+}
+
+func huffmanLookup(code uint32, nbits uint) (int, bool) {
+	for sym := 0; sym < len(huffmanCodes); sym++ {
+		if uint(huffmanCodeLen[sym]) == nbits && huffmanCodes[sym] == code {
+			return sym, true
+		}
+	}
+	return 0, false
+}
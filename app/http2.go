@@ -0,0 +1,638 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// http2Preface is the fixed client connection preface from RFC 7540 3.5,
+// sent before any frames on a connection negotiated via ALPN "h2".
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// Frame types (RFC 7540 11.2) this server understands. PUSH_PROMISE and
+// CONTINUATION are recognized but not produced or accepted - server push
+// isn't implemented, and header blocks are required to fit in one HEADERS
+// frame (good enough for the request/response sizes this server deals in).
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	framePriority     = 0x2
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePushPromise  = 0x5
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+	frameContinuation = 0x9
+)
+
+const (
+	flagEndStream  = 0x1
+	flagACK        = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+	flagPriority   = 0x20
+)
+
+const (
+	settingInitialWindowSize = 0x4
+	settingMaxFrameSize      = 0x5
+)
+
+const (
+	errCodeProtocol = 0x1
+	errCodeInternal = 0x2
+)
+
+const defaultInitialWindow = 65535
+const defaultMaxFrameSize = 16384
+
+var errHTTP2Protocol = errors.New("http2: protocol error")
+
+// http2Frame is one decoded frame: a 9-byte header plus its payload, as
+// laid out in RFC 7540 4.1.
+type http2Frame struct {
+	typ      byte
+	flags    byte
+	streamID uint32
+	payload  []byte
+}
+
+func readHTTP2Frame(r io.Reader) (*http2Frame, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	payload := make([]byte, length)
+	if length > 0 {
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	return &http2Frame{
+		typ:      header[3],
+		flags:    header[4],
+		streamID: binary.BigEndian.Uint32(header[5:9]) & 0x7fffffff,
+		payload:  payload,
+	}, nil
+}
+
+func encodeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// http2Conn is the per-connection state for an HTTP/2 session: the
+// write-serializing lock every stream's goroutine shares, the HPACK
+// decoder (stateful across the whole connection via its dynamic table),
+// and the flow-control windows that gate outbound DATA frames.
+type http2Conn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+	decoder *hpackDecoder
+
+	maxFrameSize uint32
+
+	windowMu         sync.Mutex
+	windowCond       *sync.Cond
+	closed           bool
+	initialWindow    int64
+	connSendWindow   int64
+	streamSendWindow map[uint32]int64
+
+	streamsMu sync.Mutex
+	bodies    map[uint32]*http2RequestBody
+}
+
+func newHTTP2Conn(conn net.Conn) *http2Conn {
+	c := &http2Conn{
+		conn:             conn,
+		decoder:          newHPACKDecoder(),
+		maxFrameSize:     defaultMaxFrameSize,
+		initialWindow:    defaultInitialWindow,
+		connSendWindow:   defaultInitialWindow,
+		streamSendWindow: make(map[uint32]int64),
+		bodies:           make(map[uint32]*http2RequestBody),
+	}
+	c.windowCond = sync.NewCond(&c.windowMu)
+	return c
+}
+
+// http2RequestBody is the per-stream pump for inbound DATA frames: content
+// handed to it by dispatchData is queued and drained into the request
+// body's pipe by its own goroutine, mirroring fcgiRequest in fcgi.go.
+// dispatchData runs on handleHTTP2Connection's single connection-wide frame
+// loop, so if it wrote straight into the pipe and the stream's handler read
+// slowly, it would stall HEADERS/DATA/SETTINGS/PING for every other stream
+// multiplexed on the same connection.
+type http2RequestBody struct {
+	pw *io.PipeWriter
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	closed bool
+	err    error
+}
+
+func newHTTP2RequestBody(pw *io.PipeWriter) *http2RequestBody {
+	b := &http2RequestBody{pw: pw}
+	b.cond = sync.NewCond(&b.mu)
+	go b.pump()
+	return b
+}
+
+// push hands content to the pump goroutine. It never blocks on the pipe
+// itself, so it's safe to call from dispatchData.
+func (b *http2RequestBody) push(content []byte) {
+	b.mu.Lock()
+	b.queue = append(b.queue, content)
+	b.cond.Signal()
+	b.mu.Unlock()
+}
+
+// finish marks the stream done (err is nil on END_STREAM), letting the pump
+// goroutine close the pipe once it has drained whatever was already queued.
+func (b *http2RequestBody) finish(err error) {
+	b.mu.Lock()
+	b.closed = true
+	b.err = err
+	b.cond.Signal()
+	b.mu.Unlock()
+}
+
+// pump is this stream's only writer to its pipe. It blocks on a slow
+// handler same as before, but that blocking is now scoped to this goroutine
+// instead of the connection's shared frame-reading loop.
+func (b *http2RequestBody) pump() {
+	for {
+		b.mu.Lock()
+		for len(b.queue) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if len(b.queue) == 0 {
+			err := b.err
+			b.mu.Unlock()
+			b.pw.CloseWithError(err)
+			return
+		}
+		chunk := b.queue[0]
+		b.queue = b.queue[1:]
+		b.mu.Unlock()
+
+		// A write error just means the handler gave up reading; keep
+		// draining the queue (cheaply, since writes after that return
+		// immediately) until finish() tells us there's nothing more coming.
+		b.pw.Write(chunk)
+	}
+}
+
+func (c *http2Conn) writeFrame(typ, flags byte, streamID uint32, payload []byte) error {
+	header := make([]byte, 9)
+	length := len(payload)
+	header[0] = byte(length >> 16)
+	header[1] = byte(length >> 8)
+	header[2] = byte(length)
+	header[3] = typ
+	header[4] = flags
+	binary.BigEndian.PutUint32(header[5:], streamID)
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if _, err := c.conn.Write(header); err != nil {
+		return err
+	}
+	if len(payload) > 0 {
+		if _, err := c.conn.Write(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *http2Conn) applySettings(payload []byte) {
+	for i := 0; i+6 <= len(payload); i += 6 {
+		id := binary.BigEndian.Uint16(payload[i : i+2])
+		value := binary.BigEndian.Uint32(payload[i+2 : i+6])
+		switch id {
+		case settingInitialWindowSize:
+			c.windowMu.Lock()
+			c.initialWindow = int64(value)
+			c.windowMu.Unlock()
+		case settingMaxFrameSize:
+			if value >= defaultMaxFrameSize {
+				c.maxFrameSize = value
+			}
+		}
+	}
+}
+
+func (c *http2Conn) initStreamSendWindow(streamID uint32) {
+	c.windowMu.Lock()
+	c.streamSendWindow[streamID] = c.initialWindow
+	c.windowMu.Unlock()
+}
+
+func (c *http2Conn) applyWindowUpdate(streamID uint32, increment int) {
+	c.windowMu.Lock()
+	if streamID == 0 {
+		c.connSendWindow += int64(increment)
+	} else if _, ok := c.streamSendWindow[streamID]; ok {
+		c.streamSendWindow[streamID] += int64(increment)
+	}
+	c.windowCond.Broadcast()
+	c.windowMu.Unlock()
+}
+
+// reserveSendWindow blocks until the connection and stream windows both
+// have room, then claims and returns as much of want as fits in one frame
+// (bounded by both windows and maxFrameSize). Returns 0 once the
+// connection has been closed out from under a waiting writer.
+func (c *http2Conn) reserveSendWindow(streamID uint32, want int) int {
+	c.windowMu.Lock()
+	defer c.windowMu.Unlock()
+	for {
+		if c.closed {
+			return 0
+		}
+		avail := c.connSendWindow
+		if sw, ok := c.streamSendWindow[streamID]; ok && sw < avail {
+			avail = sw
+		}
+		if avail > 0 {
+			n := want
+			if int64(n) > avail {
+				n = int(avail)
+			}
+			if n > int(c.maxFrameSize) {
+				n = int(c.maxFrameSize)
+			}
+			c.connSendWindow -= int64(n)
+			c.streamSendWindow[streamID] -= int64(n)
+			return n
+		}
+		c.windowCond.Wait()
+	}
+}
+
+func (c *http2Conn) closeStream(streamID uint32) {
+	c.windowMu.Lock()
+	delete(c.streamSendWindow, streamID)
+	c.windowMu.Unlock()
+
+	c.streamsMu.Lock()
+	delete(c.bodies, streamID)
+	c.streamsMu.Unlock()
+}
+
+func (c *http2Conn) registerBody(streamID uint32, body *http2RequestBody) {
+	c.streamsMu.Lock()
+	c.bodies[streamID] = body
+	c.streamsMu.Unlock()
+}
+
+func (c *http2Conn) abortStream(streamID uint32, err error) {
+	c.streamsMu.Lock()
+	body := c.bodies[streamID]
+	delete(c.bodies, streamID)
+	c.streamsMu.Unlock()
+	if body != nil {
+		body.finish(err)
+	}
+}
+
+func (c *http2Conn) close() {
+	c.windowMu.Lock()
+	c.closed = true
+	c.windowCond.Broadcast()
+	c.windowMu.Unlock()
+}
+
+// dispatchData routes a DATA frame's payload to the matching stream's
+// request-body pipe and replenishes the flow-control window it consumed.
+// Replenishing immediately (rather than, say, when the handler actually
+// reads the bytes) keeps the window from ever needing to stall a sender,
+// at the cost of not applying real backpressure.
+func (c *http2Conn) dispatchData(frame *http2Frame) error {
+	payload := frame.payload
+	if frame.flags&flagPadded != 0 {
+		if len(payload) == 0 {
+			return errHTTP2Protocol
+		}
+		padLen := int(payload[0])
+		payload = payload[1:]
+		if padLen > len(payload) {
+			return errHTTP2Protocol
+		}
+		payload = payload[:len(payload)-padLen]
+	}
+
+	c.streamsMu.Lock()
+	body := c.bodies[frame.streamID]
+	c.streamsMu.Unlock()
+
+	if body != nil && len(payload) > 0 {
+		body.push(payload)
+	}
+	// Flow control counts the whole frame payload, padding included.
+	if consumed := len(frame.payload); consumed > 0 {
+		c.writeFrame(frameWindowUpdate, 0, frame.streamID, encodeUint32(uint32(consumed)))
+		c.writeFrame(frameWindowUpdate, 0, 0, encodeUint32(uint32(consumed)))
+	}
+
+	if frame.flags&flagEndStream != 0 && body != nil {
+		body.finish(nil)
+		c.streamsMu.Lock()
+		delete(c.bodies, frame.streamID)
+		c.streamsMu.Unlock()
+	}
+	return nil
+}
+
+// writeDataFrame splits data across as many DATA frames as the flow
+// control windows require, setting END_STREAM on the final one (or on a
+// standalone empty frame if endStream is requested with no bytes left).
+func (c *http2Conn) writeDataFrame(streamID uint32, data []byte, endStream bool) error {
+	if len(data) == 0 {
+		flags := byte(0)
+		if endStream {
+			flags = flagEndStream
+		}
+		return c.writeFrame(frameData, flags, streamID, nil)
+	}
+
+	for len(data) > 0 {
+		n := c.reserveSendWindow(streamID, len(data))
+		if n <= 0 {
+			return errors.New("http2: connection closed while waiting for flow control window")
+		}
+		chunk := data[:n]
+		data = data[n:]
+
+		flags := byte(0)
+		if endStream && len(data) == 0 {
+			flags = flagEndStream
+		}
+		if err := c.writeFrame(frameData, flags, streamID, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newHTTP2Request turns a decoded HPACK header block into the *http.Request
+// the router already knows how to dispatch, so handlers don't have to care
+// which protocol a request arrived over.
+func newHTTP2Request(fields []hpackHeaderField, remoteAddr string) (*http.Request, error) {
+	var method, path, scheme, authority string
+	header := make(http.Header)
+
+	for _, f := range fields {
+		switch f.name {
+		case ":method":
+			method = f.value
+		case ":path":
+			path = f.value
+		case ":scheme":
+			scheme = f.value
+		case ":authority":
+			authority = f.value
+		default:
+			if strings.HasPrefix(f.name, ":") {
+				continue
+			}
+			header.Add(f.name, f.value)
+		}
+	}
+	if method == "" || path == "" {
+		return nil, errHTTP2Protocol
+	}
+	if authority == "" {
+		authority = header.Get("Host")
+	}
+
+	u, err := url.ParseRequestURI(path)
+	if err != nil {
+		return nil, err
+	}
+	u.Scheme = scheme
+	u.Host = authority
+
+	req := &http.Request{
+		Method:     method,
+		URL:        u,
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		ProtoMinor: 0,
+		Header:     header,
+		Host:       authority,
+		RemoteAddr: remoteAddr,
+		RequestURI: path,
+	}
+	if cl := header.Get("Content-Length"); cl != "" {
+		if n, err := strconv.ParseInt(cl, 10, 64); err == nil {
+			req.ContentLength = n
+		}
+	}
+	return req, nil
+}
+
+// handleHTTP2Headers decodes a HEADERS frame into a request and, unless the
+// stream ended with the headers, wires up a pipe for the DATA frames that
+// will carry its body. The actual dispatch runs on its own goroutine per
+// RFC 7540's stream multiplexing - one slow request never blocks another
+// stream on the same connection.
+func (server *Server) handleHTTP2Headers(h2 *http2Conn, frame *http2Frame) error {
+	payload := frame.payload
+	if frame.flags&flagPadded != 0 {
+		if len(payload) == 0 {
+			return errHTTP2Protocol
+		}
+		padLen := int(payload[0])
+		payload = payload[1:]
+		if padLen > len(payload) {
+			return errHTTP2Protocol
+		}
+		payload = payload[:len(payload)-padLen]
+	}
+	if frame.flags&flagPriority != 0 {
+		if len(payload) < 5 {
+			return errHTTP2Protocol
+		}
+		payload = payload[5:]
+	}
+	if frame.flags&flagEndHeaders == 0 {
+		return errors.New("http2: header blocks split across CONTINUATION frames are not supported")
+	}
+
+	fields, err := h2.decoder.decodeFields(payload)
+	if err != nil {
+		return err
+	}
+
+	h2.initStreamSendWindow(frame.streamID)
+
+	req, err := newHTTP2Request(fields, h2.conn.RemoteAddr().String())
+	if err != nil {
+		h2.writeFrame(frameRSTStream, 0, frame.streamID, encodeUint32(errCodeProtocol))
+		h2.closeStream(frame.streamID)
+		return nil
+	}
+
+	if frame.flags&flagEndStream != 0 {
+		req.Body = http.NoBody
+	} else {
+		pr, pw := io.Pipe()
+		req.Body = pr
+		h2.registerBody(frame.streamID, newHTTP2RequestBody(pw))
+	}
+
+	go server.serveHTTP2Stream(h2, frame.streamID, req)
+	return nil
+}
+
+func (server *Server) serveHTTP2Stream(h2 *http2Conn, streamID uint32, req *http.Request) {
+	resp := server.router.Dispatch(req)
+	h2.writeResponse(streamID, resp)
+}
+
+// writeResponse encodes resp as a HEADERS frame (with an HPACK-encoded
+// ":status" pseudo-header leading the rest) followed by however many DATA
+// frames its body takes, then frees the stream's bookkeeping.
+func (c *http2Conn) writeResponse(streamID uint32, resp *http.Response) {
+	defer c.closeStream(streamID)
+	if resp == nil {
+		resp = notFoundResponse()
+	}
+	stripHopByHopHeaders(resp.Header)
+	if resp.ContentLength >= 0 {
+		resp.Header.Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+	}
+
+	block := encodeHPACKHeaderField(":status", strconv.Itoa(resp.StatusCode))
+	for name, values := range resp.Header {
+		for _, v := range values {
+			block = append(block, encodeHPACKHeaderField(name, v)...)
+		}
+	}
+
+	noBody := resp.Body == nil
+	flags := byte(flagEndHeaders)
+	if noBody {
+		flags |= flagEndStream
+	}
+	if err := c.writeFrame(frameHeaders, flags, streamID, block); err != nil || noBody {
+		return
+	}
+	defer resp.Body.Close()
+
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if werr := c.writeDataFrame(streamID, buf[:n], false); werr != nil {
+				return
+			}
+		}
+		if err == io.EOF {
+			c.writeDataFrame(streamID, nil, true)
+			return
+		}
+		if err != nil {
+			c.writeFrame(frameRSTStream, 0, streamID, encodeUint32(errCodeInternal))
+			return
+		}
+	}
+}
+
+// handleHTTP2Connection speaks the HTTP/2 framing layer (RFC 7540) over a
+// connection whose ALPN negotiation already picked "h2". It multiplexes
+// concurrent streams through a goroutine per request, all of them funneled
+// back through the same router and middleware chain http/1.1 uses - a
+// handler never knows which protocol delivered its request.
+//
+// Scope is deliberately limited to what this server needs: no server push,
+// no CONTINUATION (the router's responses and this app's request headers
+// all fit in one HEADERS frame), and no dynamic-table-size renegotiation
+// beyond what a client sends unprompted.
+func (server *Server) handleHTTP2Connection(conn net.Conn) {
+	defer conn.Close()
+
+	preface := make([]byte, len(http2Preface))
+	if _, err := io.ReadFull(conn, preface); err != nil || string(preface) != http2Preface {
+		return
+	}
+
+	h2 := newHTTP2Conn(conn)
+	defer h2.close()
+	if err := h2.writeFrame(frameSettings, 0, 0, nil); err != nil {
+		return
+	}
+
+	for {
+		frame, err := readHTTP2Frame(conn)
+		if err != nil {
+			return
+		}
+
+		switch frame.typ {
+		case frameSettings:
+			if frame.flags&flagACK != 0 {
+				continue
+			}
+			h2.applySettings(frame.payload)
+			if err := h2.writeFrame(frameSettings, flagACK, 0, nil); err != nil {
+				return
+			}
+
+		case framePing:
+			if frame.flags&flagACK != 0 {
+				continue
+			}
+			if err := h2.writeFrame(framePing, flagACK, 0, frame.payload); err != nil {
+				return
+			}
+
+		case frameWindowUpdate:
+			if len(frame.payload) != 4 {
+				return
+			}
+			increment := int(binary.BigEndian.Uint32(frame.payload) & 0x7fffffff)
+			h2.applyWindowUpdate(frame.streamID, increment)
+
+		case framePriority:
+			// Reprioritizing output isn't implemented; acknowledging the
+			// frame by doing nothing is spec-legal (RFC 7540 5.3).
+
+		case frameHeaders:
+			if err := server.handleHTTP2Headers(h2, frame); err != nil {
+				return
+			}
+
+		case frameData:
+			if err := h2.dispatchData(frame); err != nil {
+				return
+			}
+
+		case frameRSTStream:
+			h2.abortStream(frame.streamID, errors.New("http2: stream reset by client"))
+
+		case frameGoAway:
+			return
+
+		default:
+			// Unknown frame type: RFC 7540 4.1 requires ignoring it.
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+// TestHTTP2RequestBodyPushDoesNotBlock guards against the bug
+// dispatchData used to have: pushing DATA frame payload for a stream must
+// never block on that stream's pipe reader, since push is called from
+// handleHTTP2Connection's single connection-wide frame loop.
+func TestHTTP2RequestBodyPushDoesNotBlock(t *testing.T) {
+	pr, pw := io.Pipe()
+	body := newHTTP2RequestBody(pw)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 8; i++ {
+			body.push([]byte("chunk"))
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push blocked waiting for a reader, defeating per-stream multiplexing")
+	}
+
+	body.finish(nil)
+
+	data, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := 8 * len("chunk"); len(data) != want {
+		t.Fatalf("got %d bytes, want %d", len(data), want)
+	}
+}
+
+// TestHTTP2RequestBodyUnreadStreamDoesNotStallOthers reproduces the
+// connection-wide head-of-line blocking this type fixes: stream A's reader
+// never reads, and stream B's data must still arrive promptly instead of
+// waiting behind A.
+func TestHTTP2RequestBodyUnreadStreamDoesNotStallOthers(t *testing.T) {
+	_, pwA := io.Pipe()
+	bodyA := newHTTP2RequestBody(pwA)
+	defer bodyA.finish(nil)
+
+	prB, pwB := io.Pipe()
+	bodyB := newHTTP2RequestBody(pwB)
+	defer bodyB.finish(nil)
+
+	// Stream A's pipe reader is discarded above, so it is never read from.
+	bodyA.push([]byte("stream A data, never read"))
+	bodyB.push([]byte("stream B data"))
+
+	readB := make(chan []byte, 1)
+	go func() {
+		buf := make([]byte, len("stream B data"))
+		io.ReadFull(prB, buf)
+		readB <- buf
+	}()
+
+	select {
+	case got := <-readB:
+		if string(got) != "stream B data" {
+			t.Fatalf("got %q, want %q", got, "stream B data")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stream B's data never arrived - stream A's unread pipe stalled it")
+	}
+}
@@ -2,16 +2,19 @@ package main
 
 import (
 	"bufio"
-	"bytes"
-	"compress/gzip"
 	"context"
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
 	"os"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 )
 
 // Ensures gofmt doesn't remove the "net" and "os" imports above (feel free to remove this!)
@@ -20,13 +23,33 @@ var _ = os.Exit
 
 const (
 	CRLF string = "\r\n"
+
+	// streamingThreshold is the body size above which responses are sent
+	// with Transfer-Encoding: chunked instead of being fully sized up front,
+	// so the connection can start sending before the whole payload is known.
+	streamingThreshold = 1 << 16 // 64 KiB
+
+	// copyBufferSize bounds the buffer used when streaming request bodies
+	// and files so a multi-GB transfer doesn't have to fit in memory.
+	copyBufferSize = 32 * 1024
 )
 
+// ErrShutdown is the cause recorded on Server.ctx when shutdown was
+// triggered by a SIGINT/SIGTERM rather than a listener error.
+var ErrShutdown = errors.New("server: shutdown requested")
+
 type Server struct {
 	ctx             context.Context
 	listener        net.Listener
 	directory       string
-	activeRequests  []http.Request
+	router          *Router
+	upstream        string
+	proxyPool       *proxyPool
+	fcgi            *fcgiClient
+	shutdownTimeout time.Duration
+	wg              sync.WaitGroup
+	connsMu         sync.Mutex
+	conns           map[net.Conn]struct{}
 	errCh           chan error
 	cancelCauseFunc context.CancelCauseFunc
 }
@@ -35,13 +58,40 @@ func main() {
 	server := createNewServer()
 
 	directory := flag.String("directory", "", "directory path for files endpoint")
+	upstream := flag.String("upstream", "", "host:port to forward /proxy/... requests to")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for in-flight connections to drain on shutdown before forcing them closed")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file; enables TLS termination")
+	tlsKey := flag.String("tls-key", "", "PEM private key file, used with -tls-cert")
+	tlsAuto := flag.Bool("tls-auto", false, "terminate TLS with a generated self-signed certificate (local dev only)")
+	fcgiTarget := flag.String("fcgi", "", "FastCGI responder address (tcp://host:port or unix:///path); when set, /files and /cgi requests are forwarded to it instead of the local directory")
 	flag.Parse()
 
 	server.directory = *directory
-	server.run()
+	server.upstream = *upstream
+	server.proxyPool = newProxyPool()
+	server.shutdownTimeout = *shutdownTimeout
+
+	if *fcgiTarget != "" {
+		network, address, err := parseFCGITarget(*fcgiTarget)
+		if err != nil {
+			fmt.Println("fcgi setup failed:", err)
+			os.Exit(1)
+		}
+		server.fcgi = newFCGIClient(network, address)
+	}
+
+	server.router = server.newRouter()
 
-	// wait for cancel channel of the server to cancel connection
+	if *tlsAuto || *tlsCert != "" {
+		listener, err := wrapTLSListener(server.listener, *tlsCert, *tlsKey, *tlsAuto)
+		if err != nil {
+			fmt.Println("tls setup failed:", err)
+			os.Exit(1)
+		}
+		server.listener = listener
+	}
 
+	server.run()
 }
 
 func createNewServer() *Server {
@@ -55,197 +105,188 @@ func createNewServer() *Server {
 	return &Server{
 		ctx:             ctx,
 		listener:        listener,
-		activeRequests:  make([]http.Request, 0),
+		conns:           make(map[net.Conn]struct{}),
 		errCh:           make(chan error),
 		cancelCauseFunc: cancelcause,
 	}
 }
 
-func (server Server) run() {
-	go func() error {
-		// wait for connections, handle one at a time
-		for {
-			conn, err := server.listener.Accept()
-			if err != nil {
-				server.errCh <- err
-			}
-			go server.handleConnection(conn)
-		}
-	}()
-
-	<-server.errCh
+// newRouter wires up the endpoints this server exposes. It's a method so
+// handlers can close over the *Server pointer and always see the directory
+// configured in main, rather than a copy taken before flags were parsed.
+func (server *Server) newRouter() *Router {
+	router := NewRouter()
+	router.Use(accessLogMiddleware)
+	router.Use(connectionCloseMiddleware)
+	router.Use(gzipMiddleware)
+
+	router.Handle(http.MethodGet, "/", func(req *http.Request, params map[string]string) *http.Response {
+		return newResponse(http.StatusOK)
+	})
+	router.Handle(http.MethodGet, "/echo/{msg...}", func(req *http.Request, params map[string]string) *http.Response {
+		return server.handleEcho(req, params)
+	})
+	router.Handle(http.MethodGet, "/user-agent", func(req *http.Request, params map[string]string) *http.Response {
+		return server.handleUserAgent(req, params)
+	})
+	router.Handle(http.MethodGet, "/files/{name}", func(req *http.Request, params map[string]string) *http.Response {
+		return server.handleFilesGet(req, params)
+	})
+	router.Handle(http.MethodPost, "/files/{name}", func(req *http.Request, params map[string]string) *http.Response {
+		return server.handleFilesPost(req, params)
+	})
+	router.Handle("*", "/proxy/{path...}", func(req *http.Request, params map[string]string) *http.Response {
+		return server.handleProxy(req, params)
+	})
+	router.Handle("*", "/cgi/{path...}", func(req *http.Request, params map[string]string) *http.Response {
+		return server.handleCGI(req, params)
+	})
+
+	return router
 }
 
-func (server Server) handleConnection(conn net.Conn) {
-	defer conn.Close()
-	reader := bufio.NewReader(conn)
-
-	// inside same connection read many times
-	for {
-		// parse the request
-		request, err := http.ReadRequest(reader)
-		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				break
-			}
-			fmt.Println("maybe serious error: ", err)
-			server.errCh <- err
-			break
-		}
-
-		//fmt.Println("req: ", request)
-		// parse the request path
-		path, rest := returnFirstSegmentOfThePath(request.URL.Path)
-		switch path {
-		case "":
-			conn.Write([]byte("HTTP/1.1 200 OK\r\n\r\n"))
-		case "echo":
-			server.handleEcho(conn, request, rest)
-		case "user-agent":
-			server.handleUserAgent(conn, request)
-		case "files":
-			switch request.Method {
-			case http.MethodGet:
-				server.handleFilesGet(conn, request, rest)
-			case http.MethodPost:
-				server.handleFilesPost(conn, request, rest)
-			}
-
-		default:
-			return404(conn)
-		}
-
-		// if connection is supposed to be closed break and clsoe the connection
-		if request.Header.Get("Connection") == "close" {
-			break
-		}
+// run accepts connections until the listener errors or a shutdown is
+// requested, then waits for in-flight connections to drain (up to
+// shutdownTimeout) before forcing whatever's left closed.
+func (server *Server) run() {
+	go server.watchForShutdownSignal()
+	go server.acceptLoop()
+
+	select {
+	case err := <-server.errCh:
+		fmt.Println("listener error:", err)
+	case <-server.ctx.Done():
+		fmt.Println("shutting down:", context.Cause(server.ctx))
 	}
 
-}
+	drained := make(chan struct{})
+	go func() {
+		server.wg.Wait()
+		close(drained)
+	}()
 
-func (server Server) handleEcho(conn net.Conn, req *http.Request, restStr string) {
-	respondSuccessWithBody(conn, req, restStr, "text/plain", req.Header.Get("Accept-Encoding"))
+	select {
+	case <-drained:
+	case <-time.After(server.shutdownTimeout):
+		fmt.Println("shutdown timeout exceeded, forcing remaining connections closed")
+		server.closeActiveConns()
+		<-drained
+	}
 }
 
-func (server Server) handleUserAgent(conn net.Conn, req *http.Request) {
-	respondSuccessWithBody(conn, req, req.Header.Get("User-Agent"), "text/plain")
+// watchForShutdownSignal cancels server.ctx and closes the listener on the
+// first SIGINT/SIGTERM, which unblocks acceptLoop's Accept call and lets
+// run's select move on to draining in-flight connections.
+func (server *Server) watchForShutdownSignal() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	<-sigCh
 
+	server.cancelCauseFunc(ErrShutdown)
+	server.listener.Close()
 }
 
-func (server Server) handleFilesGet(conn net.Conn, req *http.Request, fileName string) {
-	filePath := string(server.directory + "/" + fileName)
+func (server *Server) acceptLoop() {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			select {
+			case <-server.ctx.Done():
+				// Expected: watchForShutdownSignal closed the listener.
+				return
+			default:
+				server.errCh <- err
+				return
+			}
+		}
 
-	fileBytes, err := os.ReadFile(filePath)
-	if err != nil {
-		return404(conn)
-		return
+		server.trackConn(conn)
+		server.wg.Add(1)
+		go func() {
+			defer server.wg.Done()
+			defer server.untrackConn(conn)
+			server.dispatchConnection(conn)
+		}()
 	}
-
-	respondSuccessWithBody(conn, req, string(fileBytes), "application/octet-stream")
 }
 
-func (server Server) handleFilesPost(conn net.Conn, req *http.Request, fileName string) {
-	filePath := string(server.directory + "/" + fileName)
-
-	file, err := os.Create(filePath)
-	if err != nil {
-		return404(conn)
-		return
-	}
-
-	body, err := io.ReadAll(req.Body)
-	if err != nil {
-		return404(conn)
-		return
-	}
-
-	_, err = file.Write(body)
-	if err != nil {
-		return404(conn)
-		return
-	}
-
-	respondSuccess201(conn, "application/octet-stream")
+func (server *Server) trackConn(conn net.Conn) {
+	server.connsMu.Lock()
+	server.conns[conn] = struct{}{}
+	server.connsMu.Unlock()
 }
 
-func return404(conn net.Conn) {
-	conn.Write([]byte("HTTP/1.1 404 Not Found\r\n\r\n"))
+func (server *Server) untrackConn(conn net.Conn) {
+	server.connsMu.Lock()
+	delete(server.conns, conn)
+	server.connsMu.Unlock()
 }
 
-func respondSuccessWithBody(conn net.Conn, req *http.Request, respBody string, contentType string, contentEncoding ...string) {
-	resp := http.Response{
-		Status:     http.StatusText(http.StatusOK),
-		StatusCode: http.StatusOK,
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header:     make(http.Header),
+func (server *Server) closeActiveConns() {
+	server.connsMu.Lock()
+	defer server.connsMu.Unlock()
+	for conn := range server.conns {
+		conn.Close()
 	}
-	resp.Header.Set("Content-Type", contentType)
-
-	if len(contentEncoding) > 0 && strings.Contains(contentEncoding[0], "gzip") {
-		n, compressedData := compressWithGzip([]byte(respBody))
-		if n < 0 {
-			return404(conn)
-		}
-		resp.Body = io.NopCloser(bytes.NewReader(compressedData))
-		resp.ContentLength = int64(len(compressedData))
-		resp.Header.Set("Content-Encoding", "gzip")
-	} else {
-		resp.Body = io.NopCloser(strings.NewReader(respBody))
-		resp.ContentLength = int64(len(respBody))
-	}
-
-	if req.Header.Get("Connection") == "close" {
-		resp.Header.Set("Connection", "close")
-	}
-
-	resp.Write(conn)
 }
 
-func respondSuccess201(conn net.Conn, contentType string) {
-
-	resp := http.Response{
-		Status:     http.StatusText(http.StatusCreated),
-		StatusCode: http.StatusCreated,
-		ProtoMajor: 1,
-		ProtoMinor: 1,
-		Header:     make(http.Header),
+// dispatchConnection picks the protocol handler for conn. Plain and
+// tls.Conn connections both go to the http/1.1 handler unless the TLS
+// handshake's ALPN negotiation picked "h2", in which case the connection
+// speaks HTTP/2 framing instead.
+func (server *Server) dispatchConnection(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			tlsConn.Close()
+			return
+		}
+		if tlsConn.ConnectionState().NegotiatedProtocol == "h2" {
+			server.handleHTTP2Connection(conn)
+			return
+		}
 	}
-	resp.Header.Set("Content-Type", contentType)
-	resp.Write(conn)
+	server.handleConnection(conn)
 }
 
-func returnFirstSegmentOfThePath(path string) (string, string) {
-	// remove the slashes in the beginning and end with Trim.
-	path = strings.Trim(path, "/")
-	if len(path) == 0 {
-		return "", ""
-	}
+func (server *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
 
-	// get the first part of the remaining path, divided with /
-	pathAndRest := strings.SplitN(path, "/", 2)
-	path = pathAndRest[0]
-	rest := ""
-	if len(pathAndRest) > 1 {
-		rest = pathAndRest[1]
-	}
+	// inside same connection read many times
+	for {
+		// parse the request
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				fmt.Println("maybe serious error: ", err)
+			}
+			break
+		}
 
-	return path, rest
-}
+		resp := server.router.Dispatch(request)
+		resp.ProtoMajor = 1
+		resp.ProtoMinor = 1
 
-func compressWithGzip(data []byte) (int, []byte) {
-	var buffer bytes.Buffer
-	writer := gzip.NewWriter(&buffer)
+		writeErr := resp.Write(conn)
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		if writeErr != nil {
+			break
+		}
 
-	n, err := writer.Write(data)
-	if err != nil {
-		return -1, nil
-	}
+		// if connection is supposed to be closed break and clsoe the connection
+		if request.Header.Get("Connection") == "close" {
+			break
+		}
 
-	err = writer.Close()
-	if err != nil {
-		return -1, nil
+		// between requests is a safe point to notice shutdown and let a
+		// keep-alive connection drain instead of reading another request.
+		select {
+		case <-server.ctx.Done():
+			return
+		default:
+		}
 	}
 
-	return n, buffer.Bytes()
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// accessLogMiddleware prints one line per request, mirroring the
+// method/path/status triples a typical access log carries.
+func accessLogMiddleware(next HandlerFunc) HandlerFunc {
+	return func(req *http.Request, params map[string]string) *http.Response {
+		resp := next(req, params)
+		status := http.StatusNotFound
+		if resp != nil {
+			status = resp.StatusCode
+		}
+		fmt.Printf("%s %s -> %d\n", req.Method, req.URL.Path, status)
+		return resp
+	}
+}
+
+// connectionCloseMiddleware mirrors a "Connection: close" request header
+// back onto the response, so every handler gets this for free.
+func connectionCloseMiddleware(next HandlerFunc) HandlerFunc {
+	return func(req *http.Request, params map[string]string) *http.Response {
+		resp := next(req, params)
+		if resp != nil && req.Header.Get("Connection") == "close" {
+			resp.Header.Set("Connection", "close")
+		}
+		return resp
+	}
+}
+
+// gzipMiddleware gzip-encodes the response body when the client advertises
+// support for it and the handler hasn't already picked an encoding. A
+// streaming body (ContentLength == -1) is compressed on the fly through a
+// pipe; a sized body is compressed up front so Content-Length stays correct.
+func gzipMiddleware(next HandlerFunc) HandlerFunc {
+	return func(req *http.Request, params map[string]string) *http.Response {
+		resp := next(req, params)
+		if resp == nil || resp.Body == nil {
+			return resp
+		}
+		if !strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+			return resp
+		}
+		if resp.Header.Get("Content-Encoding") != "" {
+			return resp
+		}
+		// A 206's Content-Range describes an offset into the uncompressed
+		// resource; gzipping just that byte range would leave Content-Range
+		// and the compressed Content-Length describing two different things.
+		if resp.StatusCode == http.StatusPartialContent {
+			return resp
+		}
+
+		if resp.ContentLength < 0 {
+			body := resp.Body
+			pipeReader, pipeWriter := io.Pipe()
+			go func() {
+				defer body.Close()
+				gzipWriter := gzip.NewWriter(pipeWriter)
+				if _, err := io.CopyBuffer(gzipWriter, body, make([]byte, copyBufferSize)); err != nil {
+					pipeWriter.CloseWithError(err)
+					return
+				}
+				pipeWriter.CloseWithError(gzipWriter.Close())
+			}()
+			resp.Body = pipeReader
+			resp.Header.Set("Content-Encoding", "gzip")
+			return resp
+		}
+
+		data, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			resp.Body = io.NopCloser(bytes.NewReader(nil))
+			return resp
+		}
+
+		n, compressed := compressWithGzip(data)
+		if n < 0 {
+			resp.Body = io.NopCloser(bytes.NewReader(data))
+			resp.ContentLength = int64(len(data))
+			return resp
+		}
+
+		resp.Body = io.NopCloser(bytes.NewReader(compressed))
+		resp.ContentLength = int64(len(compressed))
+		resp.Header.Set("Content-Encoding", "gzip")
+		return resp
+	}
+}
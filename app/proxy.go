@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// hopByHopHeaders are stripped from both the forwarded request and the
+// upstream response per RFC 7230 6.1 - they describe this hop only, not
+// the end-to-end message.
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"TE",
+	"Trailers",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+func stripHopByHopHeaders(header http.Header) {
+	for _, h := range hopByHopHeaders {
+		header.Del(h)
+	}
+}
+
+// pooledConn bundles an upstream connection with the bufio.Reader used to
+// parse responses off it, so a connection returned to the pool doesn't lose
+// whatever the reader has already buffered.
+type pooledConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// proxyPool keeps idle upstream connections per "host:port" so repeated
+// /proxy requests to the same upstream don't pay a fresh TCP+dial cost each
+// time, mirroring the MaxIdleConnsPerHost pattern of net/http's Transport.
+type proxyPool struct {
+	mu             sync.Mutex
+	idle           map[string][]*pooledConn
+	maxIdlePerHost int
+}
+
+func newProxyPool() *proxyPool {
+	return &proxyPool{
+		idle:           make(map[string][]*pooledConn),
+		maxIdlePerHost: 8,
+	}
+}
+
+func (p *proxyPool) get(hostPort string) (*pooledConn, error) {
+	p.mu.Lock()
+	if conns := p.idle[hostPort]; len(conns) > 0 {
+		pc := conns[len(conns)-1]
+		p.idle[hostPort] = conns[:len(conns)-1]
+		p.mu.Unlock()
+		return pc, nil
+	}
+	p.mu.Unlock()
+
+	conn, err := net.Dial("tcp", hostPort)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+func (p *proxyPool) put(hostPort string, pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.idle[hostPort]) >= p.maxIdlePerHost {
+		pc.conn.Close()
+		return
+	}
+	p.idle[hostPort] = append(p.idle[hostPort], pc)
+}
+
+// pooledBody is the response body handed back to the router. Closing it
+// either returns the upstream connection to the pool for reuse or, if the
+// upstream isn't keeping it alive, closes it outright.
+type pooledBody struct {
+	reader    *bufio.Reader
+	body      io.ReadCloser
+	conn      *pooledConn
+	pool      *proxyPool
+	hostPort  string
+	keepAlive bool
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	return b.body.Read(p)
+}
+
+func (b *pooledBody) Close() error {
+	b.body.Close()
+	if b.keepAlive {
+		b.pool.put(b.hostPort, b.conn)
+		return nil
+	}
+	return b.conn.conn.Close()
+}
+
+func (server *Server) handleProxy(req *http.Request, params map[string]string) *http.Response {
+	if server.upstream == "" {
+		return notFoundResponse()
+	}
+
+	pc, err := server.proxyPool.get(server.upstream)
+	if err != nil {
+		return badGatewayResponse()
+	}
+
+	outReq := req.Clone(req.Context())
+	outReq.URL.Scheme = "http"
+	outReq.URL.Host = server.upstream
+	outReq.URL.Path = "/" + params["path"]
+	outReq.Host = server.upstream
+	outReq.RequestURI = ""
+
+	stripHopByHopHeaders(outReq.Header)
+	outReq.Header.Set("X-Forwarded-For", clientHost(req.RemoteAddr))
+	outReq.Header.Set("X-Forwarded-Proto", "http")
+	if via := outReq.Header.Get("Via"); via != "" {
+		outReq.Header.Set("Via", via+", 1.1 simple-http-server")
+	} else {
+		outReq.Header.Set("Via", "1.1 simple-http-server")
+	}
+
+	if err := outReq.Write(pc.conn); err != nil {
+		pc.conn.Close()
+		return badGatewayResponse()
+	}
+
+	upstreamResp, err := http.ReadResponse(pc.reader, outReq)
+	if err != nil {
+		pc.conn.Close()
+		return badGatewayResponse()
+	}
+
+	stripHopByHopHeaders(upstreamResp.Header)
+
+	resp := newResponse(upstreamResp.StatusCode)
+	resp.Header = upstreamResp.Header
+	resp.Body = &pooledBody{
+		body:      upstreamResp.Body,
+		conn:      pc,
+		pool:      server.proxyPool,
+		hostPort:  server.upstream,
+		keepAlive: upstreamResp.ProtoAtLeast(1, 1) && !upstreamResp.Close,
+	}
+
+	if upstreamResp.ContentLength >= 0 {
+		resp.ContentLength = upstreamResp.ContentLength
+	} else {
+		resp.ContentLength = -1
+		resp.TransferEncoding = []string{"chunked"}
+	}
+
+	return resp
+}
+
+// clientHost strips the port off a "host:port" remote address, falling
+// back to the raw value if it isn't in that form.
+func clientHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// limitedReadCloser pairs a reader (typically an io.LimitReader) with the
+// Closer of the underlying resource it was derived from, so the original
+// file still gets closed even though reads go through the limiter.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func newResponse(status int) *http.Response {
+	return &http.Response{
+		Status:     http.StatusText(status),
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+}
+
+func notFoundResponse() *http.Response {
+	return newResponse(http.StatusNotFound)
+}
+
+func rangeNotSatisfiableResponse(total int64) *http.Response {
+	resp := newResponse(http.StatusRequestedRangeNotSatisfiable)
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", total))
+	return resp
+}
+
+func badGatewayResponse() *http.Response {
+	return newResponse(http.StatusBadGateway)
+}
+
+func createdResponse(contentType string) *http.Response {
+	resp := newResponse(http.StatusCreated)
+	resp.Header.Set("Content-Type", contentType)
+	return resp
+}
+
+func successResponse(body string, contentType string) *http.Response {
+	resp := newResponse(http.StatusOK)
+	resp.Header.Set("Content-Type", contentType)
+	resp.Body = io.NopCloser(strings.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp
+}
+
+// fileResponse serves body (already open, sized) as a 200 response; the
+// caller reads straight from disk instead of buffering the whole file.
+func fileResponse(body io.ReadCloser, contentType string, size int64) *http.Response {
+	resp := newResponse(http.StatusOK)
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Accept-Ranges", "bytes")
+	resp.Body = body
+	resp.ContentLength = size
+	return resp
+}
+
+// streamingResponse marks the response as chunked (ContentLength == -1) so
+// it can start going out before the whole body is known, e.g. a large file
+// or an echoed body too big to size up front.
+func streamingResponse(body io.Reader, contentType string) *http.Response {
+	resp := newResponse(http.StatusOK)
+	resp.Header.Set("Content-Type", contentType)
+	resp.ContentLength = -1
+	resp.TransferEncoding = []string{"chunked"}
+	if closer, ok := body.(io.ReadCloser); ok {
+		resp.Body = closer
+	} else {
+		resp.Body = io.NopCloser(body)
+	}
+	return resp
+}
+
+// partialContentResponse responds 206 Partial Content for the inclusive
+// byte range [start, end] of a resource of the given total size, copying
+// exactly that many bytes from body (which the caller has already seeked to
+// start).
+func partialContentResponse(body io.ReadCloser, contentType string, start, end, total int64) *http.Response {
+	length := end - start + 1
+
+	resp := newResponse(http.StatusPartialContent)
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, total))
+	resp.Header.Set("Accept-Ranges", "bytes")
+	resp.Body = limitedReadCloser{io.LimitReader(body, length), body}
+	resp.ContentLength = length
+	return resp
+}
+
+func compressWithGzip(data []byte) (int, []byte) {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+
+	n, err := writer.Write(data)
+	if err != nil {
+		return -1, nil
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return -1, nil
+	}
+
+	return n, buffer.Bytes()
+}
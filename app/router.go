@@ -0,0 +1,148 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// HandlerFunc handles a single matched request and returns the response to
+// send. It never touches the connection directly so that middleware can
+// inspect or rewrite the response before it goes out on the wire.
+type HandlerFunc func(req *http.Request, params map[string]string) *http.Response
+
+// Middleware wraps a HandlerFunc to add cross-cutting behavior (gzip
+// negotiation, connection handling, logging, ...) without the handler
+// needing to know about it.
+type Middleware func(HandlerFunc) HandlerFunc
+
+// segment is one path component of a registered route pattern: either a
+// literal ("files"), a named parameter ("{name}"), or a trailing wildcard
+// that captures the rest of the path ("{msg...}").
+type segment struct {
+	literal  string
+	param    string
+	wildcard bool
+}
+
+type route struct {
+	method   string
+	segments []segment
+	handler  HandlerFunc
+}
+
+// Router dispatches requests by method and path pattern, running the
+// matched handler through the registered middleware chain.
+type Router struct {
+	routes      []route
+	middlewares []Middleware
+}
+
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// Use appends a middleware to the chain. Middlewares run in registration
+// order on the way in (the first one registered is outermost), so it also
+// sees the fully-formed response on the way out.
+func (router *Router) Use(mw Middleware) {
+	router.middlewares = append(router.middlewares, mw)
+}
+
+// Handle registers handler for method requests matching pattern, e.g.
+// "/files/{name}" or "/echo/{msg...}". method may be "*" to match any HTTP
+// method, e.g. for a reverse proxy that forwards whatever verb it's given.
+func (router *Router) Handle(method, pattern string, handler HandlerFunc) {
+	router.routes = append(router.routes, route{
+		method:   method,
+		segments: parsePattern(pattern),
+		handler:  handler,
+	})
+}
+
+// Dispatch finds the handler matching req, wraps it with the middleware
+// chain, and returns the resulting response. Unmatched requests still run
+// through the chain so middleware like access logging applies uniformly.
+func (router *Router) Dispatch(req *http.Request) *http.Response {
+	handler, params, ok := router.match(req.Method, req.URL.Path)
+	if !ok {
+		handler = notFoundHandler
+		params = map[string]string{}
+	}
+
+	for i := len(router.middlewares) - 1; i >= 0; i-- {
+		handler = router.middlewares[i](handler)
+	}
+
+	return handler(req, params)
+}
+
+func notFoundHandler(req *http.Request, params map[string]string) *http.Response {
+	return notFoundResponse()
+}
+
+func parsePattern(pattern string) []segment {
+	pattern = strings.Trim(pattern, "/")
+	if pattern == "" {
+		return nil
+	}
+
+	parts := strings.Split(pattern, "/")
+	segments := make([]segment, 0, len(parts))
+	for _, part := range parts {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			name := part[1 : len(part)-1]
+			wildcard := strings.HasSuffix(name, "...")
+			if wildcard {
+				name = strings.TrimSuffix(name, "...")
+			}
+			segments = append(segments, segment{param: name, wildcard: wildcard})
+			continue
+		}
+		segments = append(segments, segment{literal: part})
+	}
+	return segments
+}
+
+func (router *Router) match(method, path string) (HandlerFunc, map[string]string, bool) {
+	path = strings.Trim(path, "/")
+	var pathParts []string
+	if path != "" {
+		pathParts = strings.Split(path, "/")
+	}
+
+	for _, rt := range router.routes {
+		if rt.method != method && rt.method != "*" {
+			continue
+		}
+		if params, ok := matchSegments(rt.segments, pathParts); ok {
+			return rt.handler, params, true
+		}
+	}
+	return nil, nil, false
+}
+
+func matchSegments(segments []segment, pathParts []string) (map[string]string, bool) {
+	params := make(map[string]string)
+
+	for i, seg := range segments {
+		if seg.wildcard {
+			params[seg.param] = strings.Join(pathParts[i:], "/")
+			return params, true
+		}
+		if i >= len(pathParts) {
+			return nil, false
+		}
+		if seg.param != "" {
+			params[seg.param] = pathParts[i]
+			continue
+		}
+		if seg.literal != pathParts[i] {
+			return nil, false
+		}
+	}
+
+	if len(segments) != len(pathParts) {
+		return nil, false
+	}
+	return params, true
+}
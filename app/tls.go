@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// tlsNextProtos is the ALPN protocol list offered during the TLS
+// handshake. Order matters: it's also our preference order, and an h2
+// client that also understands http/1.1 will get h2.
+var tlsNextProtos = []string{"h2", "http/1.1"}
+
+// wrapTLSListener loads certFile/keyFile (or, for tlsAuto, mints a
+// throwaway self-signed certificate) and returns listener wrapped for TLS
+// with ALPN advertising h2 and http/1.1.
+func wrapTLSListener(listener net.Listener, certFile, keyFile string, tlsAuto bool) (net.Listener, error) {
+	var cert tls.Certificate
+	var err error
+
+	if tlsAuto {
+		cert, err = generateSelfSignedCert()
+	} else {
+		cert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   tlsNextProtos,
+		MinVersion:   tls.VersionTLS12,
+	}
+	return tls.NewListener(listener, config), nil
+}
+
+// generateSelfSignedCert mints a throwaway ECDSA certificate for
+// "-tls-auto" local-dev use. It's valid for localhost, 127.0.0.1 and ::1
+// only and is never written to disk - restarting the server gets a new one.
+func generateSelfSignedCert() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	fmt.Println("tls-auto: using a freshly generated self-signed certificate for localhost")
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}